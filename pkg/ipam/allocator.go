@@ -31,8 +31,6 @@ import (
 const (
 	metricAllocate = "allocate"
 	metricRelease  = "release"
-	familyIPv4     = "ipv4"
-	familyIPv6     = "ipv6"
 )
 
 // Error definitions
@@ -86,72 +84,91 @@ func (ipam *IPAM) allocateIP(ip net.IP, needSyncUpstream bool, metadata types.Me
 	defer ipam.allocatorMutex.Unlock()
 
 	if ipam.blacklist.Contains(ip) {
-		err = fmt.Errorf("IP %s is blacklisted, owned by %s", ip.String(), metadata.Owner)
+		err = fmt.Errorf("%w: IP %s, owned by %s", ErrIPBlacklisted, ip.String(), metadata.Owner)
 		return
 	}
 
-	family := familyIPv4
-	if ip.To4() != nil {
-		if ipam.IPv4Allocator == nil {
+	if _, ok := ipam.owner[ip.String()]; ok {
+		err = fmt.Errorf("%w: IP %s", ErrIPAlreadyAllocated, ip.String())
+		return
+	}
+
+	if _, ok := ipam.containsIPLocked(ip); !ok {
+		err = fmt.Errorf("%w: IP %s", ErrIPOutOfRange, ip.String())
+		return
+	}
+
+	if err = ipam.quotaPolicy.Allow(metadata.Owner); err != nil {
+		return
+	}
+
+	pool := ipam.selectPool(metadata)
+	family := DeriveFamily(ip)
+	allocator := ipam.allocatorForPool(family, pool)
+	if allocator == nil {
+		if family == IPv4 {
 			err = ErrIPv4Disabled
-			return
+		} else {
+			err = ErrIPv6Disabled
 		}
+		return
+	}
 
-		if needSyncUpstream {
-			if _, err = ipam.IPv4Allocator.Allocate(ip, metadata); err != nil {
-				return
-			}
-		} else {
-			if _, err = ipam.IPv4Allocator.AllocateWithoutSyncUpstream(ip, metadata); err != nil {
-				return
-			}
+	if needSyncUpstream {
+		if _, err = allocator.Allocate(ip, metadata); err != nil {
+			return
 		}
 	} else {
-		family = familyIPv6
-		if ipam.IPv6Allocator == nil {
-			err = ErrIPv6Disabled
+		if _, err = allocator.AllocateWithoutSyncUpstream(ip, metadata); err != nil {
 			return
 		}
-
-		if needSyncUpstream {
-			if _, err = ipam.IPv6Allocator.Allocate(ip, metadata); err != nil {
-				return
-			}
-		} else {
-			if _, err = ipam.IPv6Allocator.AllocateWithoutSyncUpstream(ip, metadata); err != nil {
-				return
-			}
-		}
 	}
 
 	log.WithFields(logrus.Fields{
 		"ip":    ip.String(),
+		"pool":  pool,
 		"owner": metadata.Owner,
 	}).Debugf("Allocated specific IP")
 
 	ipam.owner[ip.String()] = metadata.Owner
-	metrics.IpamEvent.WithLabelValues(metricAllocate, family).Inc()
+	ipam.poolOfIP[ip.String()] = pool
+	ipam.quotaPolicy.Account(metadata.Owner, 1)
+	metrics.IpamEvent.WithLabelValues(metricAllocate, string(family), pool).Inc()
+	ipam.events.publish(IPAMEvent{
+		Op:        Allocate,
+		IP:        ip,
+		Family:    family,
+		Owner:     metadata.Owner,
+		Timestamp: time.Now(),
+	})
 	return
 }
 
-func (ipam *IPAM) allocateNextFamily(family Family, needSyncUpstream bool, metadata types.Metadata) (result *AllocationResult, err error) {
-	var allocator Allocator
-	switch family {
-	case IPv6:
-		allocator = ipam.IPv6Allocator
-	case IPv4:
-		allocator = ipam.IPv4Allocator
+func (ipam *IPAM) allocateNextFamily(family Family, pool string, needSyncUpstream bool, metadata types.Metadata) (result *AllocationResult, err error) {
+	if pool == "" {
+		pool = defaultPoolName
+	}
 
-	default:
-		err = fmt.Errorf("unknown address \"%s\" family requested", family)
+	allocator := ipam.allocatorForPool(family, pool)
+	if allocator == nil {
+		err = fmt.Errorf("%s allocator not available for pool %q", family, pool)
 		return
 	}
 
-	if allocator == nil {
-		err = fmt.Errorf("%s allocator not available", family)
+	if err = ipam.quotaPolicy.Allow(metadata.Owner); err != nil {
 		return
 	}
 
+	if ipam.quotaPolicy != nil {
+		if sizer, ok := allocator.(PoolSizer); ok {
+			allocated, _ := allocator.Dump()
+			if !ipam.quotaPolicy.PreferOwner(metadata.Owner, sizer.PoolSize(), len(allocated)) {
+				err = ErrOwnerQuotaExceeded
+				return
+			}
+		}
+	}
+
 	for {
 		if needSyncUpstream {
 			result, err = allocator.AllocateNext(metadata)
@@ -165,10 +182,21 @@ func (ipam *IPAM) allocateNextFamily(family Family, needSyncUpstream bool, metad
 		if !ipam.blacklist.Contains(result.IP) {
 			log.WithFields(logrus.Fields{
 				"ip":    result.IP.String(),
+				"pool":  pool,
 				"owner": metadata.Owner,
 			}).Debugf("Allocated random IP")
 			ipam.owner[result.IP.String()] = metadata.Owner
-			metrics.IpamEvent.WithLabelValues(metricAllocate, string(family)).Inc()
+			ipam.poolOfIP[result.IP.String()] = pool
+			result.IPPoolName = pool
+			ipam.quotaPolicy.Account(metadata.Owner, 1)
+			metrics.IpamEvent.WithLabelValues(metricAllocate, string(family), pool).Inc()
+			ipam.events.publish(IPAMEvent{
+				Op:        Allocate,
+				IP:        result.IP,
+				Family:    family,
+				Owner:     metadata.Owner,
+				Timestamp: time.Now(),
+			})
 			return
 		}
 
@@ -176,17 +204,26 @@ func (ipam *IPAM) allocateNextFamily(family Family, needSyncUpstream bool, metad
 		// blacklisted IP is now allocated so it won't be allocated in
 		// the next iteration.
 		ipam.owner[result.IP.String()] = fmt.Sprintf("%s (blacklisted)", metadata.Owner)
+		ipam.poolOfIP[result.IP.String()] = pool
+		ipam.events.publish(IPAMEvent{
+			Op:        Blacklist,
+			IP:        result.IP,
+			Family:    family,
+			Owner:     metadata.Owner,
+			Timestamp: time.Now(),
+		})
 	}
 }
 
 // AllocateNextFamily allocates the next IP of the requested address family
+// out of the pool selected by Configuration for metadata.
 func (ipam *IPAM) AllocateNextFamily(family Family, metadata types.Metadata) (result *AllocationResult, err error) {
 	ipam.allocatorMutex.Lock()
 	defer ipam.allocatorMutex.Unlock()
 
 	needSyncUpstream := true
 
-	return ipam.allocateNextFamily(family, needSyncUpstream, metadata)
+	return ipam.allocateNextFamily(family, ipam.selectPool(metadata), needSyncUpstream, metadata)
 }
 
 // AllocateNextFamilyWithoutSyncUpstream allocates the next IP of the requested address family
@@ -197,7 +234,20 @@ func (ipam *IPAM) AllocateNextFamilyWithoutSyncUpstream(family Family, metadata
 
 	needSyncUpstream := false
 
-	return ipam.allocateNextFamily(family, needSyncUpstream, metadata)
+	return ipam.allocateNextFamily(family, ipam.selectPool(metadata), needSyncUpstream, metadata)
+}
+
+// AllocateFromPool allocates the next available IP of the requested family
+// out of the named pool, bypassing Configuration's pool selector. This is
+// the primitive that lets callers route specific owners (e.g. pods in a
+// given namespace) into a dedicated CIDR instead of the default pool.
+func (ipam *IPAM) AllocateFromPool(pool string, family Family, metadata types.Metadata) (result *AllocationResult, err error) {
+	ipam.allocatorMutex.Lock()
+	defer ipam.allocatorMutex.Unlock()
+
+	needSyncUpstream := true
+
+	return ipam.allocateNextFamily(family, pool, needSyncUpstream, metadata)
 }
 
 // AllocateNext allocates the next available IPv4 and IPv6 address out of the
@@ -205,7 +255,7 @@ func (ipam *IPAM) AllocateNextFamilyWithoutSyncUpstream(family Family, metadata
 // allocation is limited to the specified address family. If the pool has been
 // drained of addresses, an error will be returned.
 func (ipam *IPAM) AllocateNext(family string, metadata types.Metadata) (ipv4Result, ipv6Result *AllocationResult, err error) {
-	if (family == "ipv6" || family == "") && ipam.IPv6Allocator != nil {
+	if (family == "ipv6" || family == "") && ipam.allocatorForPool(IPv6, ipam.selectPool(metadata)) != nil {
 		ipv6Result, err = ipam.AllocateNextFamily(IPv6, metadata)
 		if err != nil {
 			return
@@ -213,7 +263,7 @@ func (ipam *IPAM) AllocateNext(family string, metadata types.Metadata) (ipv4Resu
 
 	}
 
-	if (family == "ipv4" || family == "") && ipam.IPv4Allocator != nil {
+	if (family == "ipv4" || family == "") && ipam.allocatorForPool(IPv4, ipam.selectPool(metadata)) != nil {
 		ipv4Result, err = ipam.AllocateNextFamily(IPv4, metadata)
 		if err != nil {
 			if ipv6Result != nil {
@@ -256,35 +306,56 @@ func (ipam *IPAM) AllocateNextWithExpiration(family string, timeout time.Duratio
 }
 
 func (ipam *IPAM) releaseIPLocked(ip net.IP) error {
-	family := familyIPv4
-	if ip.To4() != nil {
-		if ipam.IPv4Allocator == nil {
-			return ErrIPv4Disabled
-		}
+	ipString := ip.String()
+	family := DeriveFamily(ip)
 
-		if err := ipam.IPv4Allocator.Release(ip); err != nil {
-			return err
-		}
-	} else {
-		family = familyIPv6
-		if ipam.IPv6Allocator == nil {
-			return ErrIPv6Disabled
-		}
+	if _, ok := ipam.containsIPLocked(ip); !ok {
+		return fmt.Errorf("%w: IP %s", ErrIPOutOfRange, ipString)
+	}
 
-		if err := ipam.IPv6Allocator.Release(ip); err != nil {
-			return err
+	pool, ok := ipam.poolOfIP[ipString]
+	if !ok {
+		pool = defaultPoolName
+	}
+
+	allocator := ipam.allocatorForPool(family, pool)
+	if allocator == nil {
+		if family == IPv4 {
+			return ErrIPv4Disabled
 		}
+		return ErrIPv6Disabled
 	}
 
-	owner := ipam.owner[ip.String()]
+	if err := allocator.Release(ip); err != nil {
+		return err
+	}
+
+	owner := ipam.owner[ipString]
 	log.WithFields(logrus.Fields{
-		"ip":    ip.String(),
+		"ip":    ipString,
+		"pool":  pool,
 		"owner": owner,
 	}).Debugf("Released IP")
-	delete(ipam.owner, ip.String())
-	delete(ipam.expirationTimers, ip.String())
+	delete(ipam.owner, ipString)
+	delete(ipam.expirationTimers, ipString)
+	delete(ipam.poolOfIP, ipString)
+	ipam.quotaPolicy.Account(owner, -1)
 
-	metrics.IpamEvent.WithLabelValues(metricRelease, family).Inc()
+	if ipam.expirationStore != nil {
+		if err := ipam.expirationStore.Delete(ipString); err != nil {
+			log.WithError(err).WithField("ip", ipString).
+				Warning("Unable to remove expiration timer from store")
+		}
+	}
+
+	metrics.IpamEvent.WithLabelValues(metricRelease, string(family), pool).Inc()
+	ipam.events.publish(IPAMEvent{
+		Op:        Release,
+		IP:        ip,
+		Family:    family,
+		Owner:     owner,
+		Timestamp: time.Now(),
+	})
 	return nil
 }
 
@@ -321,31 +392,21 @@ func (ipam *IPAM) ReleaseIPString(releaseArg string) (err error) {
 	return
 }
 
-// Dump dumps the list of allocated IP addresses
+// Dump dumps the list of allocated IP addresses across all pools of both
+// address families. The owner string is annotated with the owning
+// pool name whenever the IP was allocated from a non-default pool.
 func (ipam *IPAM) Dump() (allocv4 map[string]string, allocv6 map[string]string, status string) {
-	var st4, st6 string
-
 	ipam.allocatorMutex.RLock()
 	defer ipam.allocatorMutex.RUnlock()
 
-	if ipam.IPv4Allocator != nil {
-		allocv4, st4 = ipam.IPv4Allocator.Dump()
+	allocv4, st4 := ipam.dumpFamilyLocked(ipam.ipv4Pools)
+	allocv6, st6 := ipam.dumpFamilyLocked(ipam.ipv6Pools)
+
+	if st4 != "" {
 		st4 = "IPv4: " + st4
-		for ip := range allocv4 {
-			owner, _ := ipam.owner[ip]
-			// If owner is not available, report IP but leave owner empty
-			allocv4[ip] = owner
-		}
 	}
-
-	if ipam.IPv6Allocator != nil {
-		allocv6, st6 = ipam.IPv6Allocator.Dump()
+	if st6 != "" {
 		st6 = "IPv6: " + st6
-		for ip := range allocv6 {
-			owner, _ := ipam.owner[ip]
-			// If owner is not available, report IP but leave owner empty
-			allocv6[ip] = owner
-		}
 	}
 
 	status = strings.Join([]string{st4, st6}, ", ")
@@ -356,6 +417,35 @@ func (ipam *IPAM) Dump() (allocv4 map[string]string, allocv6 map[string]string,
 	return
 }
 
+func (ipam *IPAM) dumpFamilyLocked(pools map[string]Allocator) (map[string]string, string) {
+	if len(pools) == 0 {
+		return nil, ""
+	}
+
+	alloc := map[string]string{}
+	statuses := make([]string, 0, len(pools))
+
+	for name, allocator := range pools {
+		poolAlloc, poolStatus := allocator.Dump()
+		if name == defaultPoolName {
+			statuses = append(statuses, poolStatus)
+		} else {
+			statuses = append(statuses, fmt.Sprintf("%s[%s]", poolStatus, name))
+		}
+
+		for ip := range poolAlloc {
+			// If owner is not available, report IP but leave owner empty
+			owner := ipam.owner[ip]
+			if name != defaultPoolName {
+				owner = fmt.Sprintf("%s (pool: %s)", owner, name)
+			}
+			alloc[ip] = owner
+		}
+	}
+
+	return alloc, strings.Join(statuses, ", ")
+}
+
 // StartExpirationTimer installs an expiration timer for a previously allocated
 // IP. Unless StopExpirationTimer is called in time, the IP will be released
 // again after expiration of the specified timeout. The function will return a
@@ -368,16 +458,46 @@ func (ipam *IPAM) Dump() (allocv4 map[string]string, allocv6 map[string]string,
 // stop the expiration timer when the IP has been used.
 func (ipam *IPAM) StartExpirationTimer(ip net.IP, timeout time.Duration) (string, error) {
 	ipam.allocatorMutex.Lock()
-	defer ipam.allocatorMutex.Unlock()
 
 	ipString := ip.String()
 	if _, ok := ipam.expirationTimers[ipString]; ok {
+		ipam.allocatorMutex.Unlock()
 		return "", fmt.Errorf("expiration timer already registered")
 	}
 
 	allocationUUID := uuid.NewUUID().String()
 	ipam.expirationTimers[ipString] = allocationUUID
+	owner := ipam.owner[ipString]
+	pool, ok := ipam.poolOfIP[ipString]
+	if !ok {
+		pool = defaultPoolName
+	}
+
+	ipam.allocatorMutex.Unlock()
 
+	if ipam.expirationStore != nil {
+		entry := ExpirationEntry{
+			IP:       ipString,
+			UUID:     allocationUUID,
+			Deadline: time.Now().Add(timeout),
+			Owner:    owner,
+			Pool:     pool,
+		}
+		if err := ipam.expirationStore.Upsert(entry); err != nil {
+			log.WithError(err).WithField("ip", ipString).
+				Warning("Unable to persist expiration timer")
+		}
+	}
+
+	ipam.armExpirationTimer(ip, allocationUUID, timeout)
+
+	return allocationUUID, nil
+}
+
+// armExpirationTimer spawns the goroutine that releases ip once timeout has
+// elapsed, unless the expiration timer identified by allocationUUID has been
+// stopped or superseded in the meantime.
+func (ipam *IPAM) armExpirationTimer(ip net.IP, allocationUUID string, timeout time.Duration) {
 	go func(ip net.IP, allocationUUID string, timeout time.Duration) {
 		ipString := ip.String()
 		time.Sleep(timeout)
@@ -388,10 +508,19 @@ func (ipam *IPAM) StartExpirationTimer(ip net.IP, timeout time.Duration) (string
 		if currentUUID, ok := ipam.expirationTimers[ipString]; ok {
 			if currentUUID == allocationUUID {
 				scopedLog := log.WithFields(logrus.Fields{"ip": ipString, "uuid": allocationUUID})
+				owner := ipam.owner[ipString]
 				if err := ipam.releaseIPLocked(ip); err != nil {
 					scopedLog.WithError(err).Warning("Unable to release IP after expiration")
 				} else {
 					scopedLog.Warning("Released IP after expiration")
+					ipam.events.publish(IPAMEvent{
+						Op:        Expire,
+						IP:        ip,
+						Family:    DeriveFamily(ip),
+						Owner:     owner,
+						Timestamp: time.Now(),
+						UUID:      allocationUUID,
+					})
 				}
 			} else {
 				// This is an obsolete expiration timer. The IP
@@ -402,8 +531,6 @@ func (ipam *IPAM) StartExpirationTimer(ip net.IP, timeout time.Duration) (string
 			// Expiration timer was removed. No action is required
 		}
 	}(ip, allocationUUID, timeout)
-
-	return allocationUUID, nil
 }
 
 // StopExpirationTimer will remove the expiration timer for a particular IP.
@@ -423,5 +550,12 @@ func (ipam *IPAM) StopExpirationTimer(ip net.IP, allocationUUID string) error {
 
 	delete(ipam.expirationTimers, ipString)
 
+	if ipam.expirationStore != nil {
+		if err := ipam.expirationStore.Delete(ipString); err != nil {
+			log.WithError(err).WithField("ip", ipString).
+				Warning("Unable to remove expiration timer from store")
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,35 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"net"
+	"testing"
+
+	"github.com/cilium/cilium/pkg/ipam/types"
+)
+
+func TestAllocateIPWithoutCIDRProvider(t *testing.T) {
+	// fakeRangeAllocator does not implement CIDRProvider. No pool of
+	// this family reports its CIDRs, so containsIPLocked must not reject
+	// every static allocation as out-of-range.
+	allocator := newFakeRangeAllocator(0)
+	ipam := NewIPAM(allocator, nil, fakeTestConfig{})
+
+	ip := net.IPv4(10, 0, 0, 5)
+	if err := ipam.AllocateIP(ip, types.Metadata{Owner: "ns/pod-a"}); err != nil {
+		t.Fatalf("expected AllocateIP to succeed against an allocator with no CIDRProvider, got: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import "errors"
+
+// Error definitions for allocateIP/releaseIPLocked. These are deliberately
+// distinct sentinel errors rather than fmt.Errorf strings so that callers,
+// e.g. the operator's retry logic or the CNI daemon, can tell "bad input"
+// apart from "pool exhausted" with errors.Is instead of string matching.
+var (
+	// ErrIPOutOfRange is returned when an IP does not fall within any
+	// CIDR backing a configured pool of the matching address family
+	ErrIPOutOfRange = errors.New("IP is not contained in any configured allocation CIDR")
+
+	// ErrIPAlreadyAllocated is returned when an IP is already allocated
+	// to an owner
+	ErrIPAlreadyAllocated = errors.New("IP is already allocated")
+
+	// ErrIPBlacklisted is returned when an IP is blacklisted from
+	// allocation
+	ErrIPBlacklisted = errors.New("IP is blacklisted")
+)
@@ -0,0 +1,140 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/cilium/cilium/pkg/lock"
+)
+
+// IPAMOp describes the kind of change an IPAMEvent represents
+type IPAMOp string
+
+const (
+	// Allocate is emitted whenever an IP is handed out
+	Allocate IPAMOp = "allocate"
+	// Release is emitted whenever an IP is returned to the pool
+	Release IPAMOp = "release"
+	// Expire is emitted whenever an IP is released due to expiration
+	Expire IPAMOp = "expire"
+	// Blacklist is emitted whenever an allocation attempt hits a
+	// blacklisted IP
+	Blacklist IPAMOp = "blacklist"
+)
+
+// IPAMEvent describes a single change to the allocation state of an IP
+type IPAMEvent struct {
+	Op        IPAMOp
+	IP        net.IP
+	Family    Family
+	Owner     string
+	Timestamp time.Time
+	UUID      string
+}
+
+// eventRingSize is the number of events buffered per subscriber before a
+// slow consumer starts missing events and receiving lag markers instead.
+const eventRingSize = 1024
+
+// eventSubscriber is a single Subscribe() consumer
+type eventSubscriber struct {
+	ch     chan IPAMEvent
+	cancel context.CancelFunc
+}
+
+// eventBroadcaster fans out IPAMEvents to subscribers without ever blocking
+// the caller, and therefore never blocks allocatorMutex. Each subscriber has
+// its own bounded ring buffer; a subscriber that falls behind has its oldest
+// buffered event silently dropped and replaced with a lag marker, rather
+// than stalling allocation for everyone else.
+type eventBroadcaster struct {
+	mutex       lock.Mutex
+	subscribers map[*eventSubscriber]struct{}
+}
+
+func newEventBroadcaster() *eventBroadcaster {
+	return &eventBroadcaster{
+		subscribers: map[*eventSubscriber]struct{}{},
+	}
+}
+
+// lagMarkerEvent is emitted to a subscriber in place of an event it missed
+// because its buffer was full.
+var lagMarkerEvent = IPAMEvent{Op: "lag"}
+
+func (b *eventBroadcaster) publish(event IPAMEvent) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for sub := range b.subscribers {
+		select {
+		case sub.ch <- event:
+		default:
+			// Subscriber is too slow to keep up. Drop the oldest
+			// buffered event to make room for a lag marker so the
+			// subscriber knows it missed something, without ever
+			// blocking the publisher.
+			select {
+			case <-sub.ch:
+			default:
+			}
+			select {
+			case sub.ch <- lagMarkerEvent:
+			default:
+			}
+		}
+	}
+}
+
+func (b *eventBroadcaster) subscribe() *eventSubscriber {
+	sub := &eventSubscriber{ch: make(chan IPAMEvent, eventRingSize)}
+
+	b.mutex.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mutex.Unlock()
+
+	return sub
+}
+
+func (b *eventBroadcaster) unsubscribe(sub *eventSubscriber) {
+	b.mutex.Lock()
+	delete(b.subscribers, sub)
+	b.mutex.Unlock()
+
+	close(sub.ch)
+}
+
+// Subscribe returns a channel emitting every IPAMEvent from this point
+// forward. The channel is closed once ctx is cancelled. Subscribers that do
+// not keep up with the event rate observe a lag marker (an IPAMEvent with
+// Op "lag") in place of the events they missed, rather than blocking
+// allocation for the rest of the system.
+func (ipam *IPAM) Subscribe(ctx context.Context) <-chan IPAMEvent {
+	sub := ipam.events.subscribe()
+
+	go func() {
+		<-ctx.Done()
+		ipam.events.unsubscribe(sub)
+	}()
+
+	return sub.ch
+}
@@ -0,0 +1,62 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"testing"
+)
+
+func TestEventBroadcasterLagMarker(t *testing.T) {
+	b := newEventBroadcaster()
+	sub := b.subscribe()
+	defer b.unsubscribe(sub)
+
+	// Fill the subscriber's buffer without ever draining it, then publish
+	// one more event than it can hold. The oldest buffered event must be
+	// dropped and replaced with a lag marker instead of publish blocking.
+	for i := 0; i < eventRingSize; i++ {
+		b.publish(IPAMEvent{Op: Allocate})
+	}
+	b.publish(IPAMEvent{Op: Release})
+
+	if len(sub.ch) != eventRingSize {
+		t.Fatalf("expected subscriber buffer to stay full at %d, got %d", eventRingSize, len(sub.ch))
+	}
+
+	last := <-sub.ch
+	for i := 1; i < eventRingSize; i++ {
+		last = <-sub.ch
+	}
+
+	if last.Op != lagMarkerEvent.Op {
+		t.Fatalf("expected the last buffered event to be a lag marker, got Op %q", last.Op)
+	}
+}
+
+func TestEventBroadcasterDeliversWithoutOverflow(t *testing.T) {
+	b := newEventBroadcaster()
+	sub := b.subscribe()
+	defer b.unsubscribe(sub)
+
+	b.publish(IPAMEvent{Op: Allocate})
+	b.publish(IPAMEvent{Op: Release})
+
+	if event := <-sub.ch; event.Op != Allocate {
+		t.Fatalf("expected first event to be %q, got %q", Allocate, event.Op)
+	}
+	if event := <-sub.ch; event.Op != Release {
+		t.Fatalf("expected second event to be %q, got %q", Release, event.Op)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// expirationBucket is the name of the bbolt bucket holding expiration tuples
+var expirationBucket = []byte("ipam-expiration-timers")
+
+// ExpirationEntry is a single persisted expiration timer tuple
+type ExpirationEntry struct {
+	IP       string
+	UUID     string
+	Deadline time.Time
+	Owner    string
+
+	// Pool is the name of the pool IP was allocated from. Entries
+	// persisted before named pools existed have this empty, which replay
+	// treats as defaultPoolName.
+	Pool string
+}
+
+// ExpirationStore persists expiration timer tuples so that they survive a
+// cilium-agent restart. Implementations must be safe for concurrent use.
+type ExpirationStore interface {
+	// Upsert persists or updates the expiration entry for ip
+	Upsert(entry ExpirationEntry) error
+
+	// Delete removes the expiration entry for ip, if any
+	Delete(ip string) error
+
+	// List returns all persisted expiration entries
+	List() ([]ExpirationEntry, error)
+
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// boltExpirationStore is the default ExpirationStore implementation, backed
+// by a local BoltDB file. It is the only ExpirationStore implementation in
+// this package.
+type boltExpirationStore struct {
+	db *bbolt.DB
+}
+
+// defaultExpirationStorePath is the default location of the BoltDB file used
+// to persist expiration timers across cilium-agent restarts.
+const defaultExpirationStorePath = "/var/run/cilium/ipam-expiration.db"
+
+// NewBoltExpirationStore opens (creating if necessary) a BoltDB-backed
+// ExpirationStore at path. If path is empty, defaultExpirationStorePath is
+// used.
+func NewBoltExpirationStore(path string) (ExpirationStore, error) {
+	if path == "" {
+		path = defaultExpirationStorePath
+	}
+
+	db, err := bbolt.Open(filepath.Clean(path), 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open expiration store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(expirationBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to initialize expiration store %s: %w", path, err)
+	}
+
+	return &boltExpirationStore{db: db}, nil
+}
+
+func (s *boltExpirationStore) Upsert(entry ExpirationEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("unable to marshal expiration entry for %s: %w", entry.IP, err)
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(expirationBucket).Put([]byte(entry.IP), value)
+	})
+}
+
+func (s *boltExpirationStore) Delete(ip string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(expirationBucket).Delete([]byte(ip))
+	})
+}
+
+func (s *boltExpirationStore) List() ([]ExpirationEntry, error) {
+	var entries []ExpirationEntry
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(expirationBucket).ForEach(func(k, v []byte) error {
+			var entry ExpirationEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("unable to parse expiration entry for %s: %w", string(k), err)
+			}
+
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+func (s *boltExpirationStore) Close() error {
+	return s.db.Close()
+}
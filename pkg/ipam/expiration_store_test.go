@@ -0,0 +1,143 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeExpirationStore is a minimal in-memory ExpirationStore used to drive
+// NewIPAMWithExpirationStore's replay logic without a real BoltDB file.
+type fakeExpirationStore struct {
+	entries []ExpirationEntry
+}
+
+func (s *fakeExpirationStore) Upsert(entry ExpirationEntry) error {
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *fakeExpirationStore) Delete(ip string) error { return nil }
+
+func (s *fakeExpirationStore) List() ([]ExpirationEntry, error) {
+	return s.entries, nil
+}
+
+func (s *fakeExpirationStore) Close() error { return nil }
+
+func TestNewIPAMWithExpirationStoreReplaysExpiredEntry(t *testing.T) {
+	allocator := newFakeRangeAllocator(0)
+	store := &fakeExpirationStore{entries: []ExpirationEntry{
+		{
+			IP:       "10.0.0.5",
+			UUID:     "expired-uuid",
+			Deadline: time.Now().Add(-time.Minute),
+			Owner:    "ns/pod-a",
+			Pool:     defaultPoolName,
+		},
+	}}
+
+	ipam, err := NewIPAMWithExpirationStore(allocator, nil, fakeTestConfig{}, store)
+	if err != nil {
+		t.Fatalf("unexpected error replaying expiration store: %v", err)
+	}
+
+	if _, ok := allocator.allocated["10.0.0.5"]; ok {
+		t.Fatal("expected the already-expired IP to be released back to the allocator on replay")
+	}
+	if _, ok := ipam.owner["10.0.0.5"]; ok {
+		t.Fatal("expected IPAM owner bookkeeping to be cleared for the expired IP")
+	}
+}
+
+func TestNewIPAMWithExpirationStoreReplaysActiveEntry(t *testing.T) {
+	allocator := newFakeRangeAllocator(0)
+	store := &fakeExpirationStore{entries: []ExpirationEntry{
+		{
+			IP:       "10.0.0.7",
+			UUID:     "active-uuid",
+			Deadline: time.Now().Add(time.Hour),
+			Owner:    "ns/pod-b",
+			Pool:     defaultPoolName,
+		},
+	}}
+
+	ipam, err := NewIPAMWithExpirationStore(allocator, nil, fakeTestConfig{}, store)
+	if err != nil {
+		t.Fatalf("unexpected error replaying expiration store: %v", err)
+	}
+
+	if owner, ok := allocator.allocated["10.0.0.7"]; !ok || owner != "ns/pod-b" {
+		t.Fatalf("expected the still-active IP to be marked allocated against the real allocator, got owner %q, ok %v", owner, ok)
+	}
+	if owner := ipam.owner["10.0.0.7"]; owner != "ns/pod-b" {
+		t.Fatalf("expected IPAM owner bookkeeping to reflect the replayed owner, got %q", owner)
+	}
+	if pool := ipam.poolOfIP["10.0.0.7"]; pool != defaultPoolName {
+		t.Fatalf("expected the replayed IP's pool to be %q, got %q", defaultPoolName, pool)
+	}
+	if uuid := ipam.expirationTimers["10.0.0.7"]; uuid != "active-uuid" {
+		t.Fatalf("expected the expiration timer to be re-armed with UUID %q, got %q", "active-uuid", uuid)
+	}
+}
+
+func TestNewIPAMWithExpirationStoreFallsBackToDefaultPool(t *testing.T) {
+	allocator := newFakeRangeAllocator(0)
+	store := &fakeExpirationStore{entries: []ExpirationEntry{
+		{
+			// Entries persisted before named pools existed have no
+			// Pool recorded.
+			IP:       "10.0.0.9",
+			UUID:     "legacy-uuid",
+			Deadline: time.Now().Add(time.Hour),
+			Owner:    "ns/pod-c",
+		},
+	}}
+
+	ipam, err := NewIPAMWithExpirationStore(allocator, nil, fakeTestConfig{}, store)
+	if err != nil {
+		t.Fatalf("unexpected error replaying expiration store: %v", err)
+	}
+
+	if pool := ipam.poolOfIP["10.0.0.9"]; pool != defaultPoolName {
+		t.Fatalf("expected a Pool-less entry to fall back to %q, got %q", defaultPoolName, pool)
+	}
+}
+
+func TestNewIPAMWithExpirationStoreSkipsUnknownPool(t *testing.T) {
+	allocator := newFakeRangeAllocator(0)
+	store := &fakeExpirationStore{entries: []ExpirationEntry{
+		{
+			IP:       "10.0.0.11",
+			UUID:     "orphan-uuid",
+			Deadline: time.Now().Add(time.Hour),
+			Owner:    "ns/pod-d",
+			Pool:     "does-not-exist",
+		},
+	}}
+
+	ipam, err := NewIPAMWithExpirationStore(allocator, nil, fakeTestConfig{}, store)
+	if err != nil {
+		t.Fatalf("unexpected error replaying expiration store: %v", err)
+	}
+
+	if _, ok := allocator.allocated["10.0.0.11"]; ok {
+		t.Fatal("expected an entry referencing an unregistered pool to be skipped, not allocated")
+	}
+	if _, ok := ipam.owner["10.0.0.11"]; ok {
+		t.Fatal("expected an entry referencing an unregistered pool to leave no owner bookkeeping behind")
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cilium/cilium/pkg/ipam/types"
+	"github.com/cilium/cilium/pkg/lock"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Family is the type describing all address families supported by IPAM
+type Family string
+
+const (
+	// IPv4 is the type describing IPv4 addresses
+	IPv4 Family = "ipv4"
+
+	// IPv6 is the type describing IPv6 addresses
+	IPv6 Family = "ipv6"
+)
+
+// DeriveFamily derives the address family of an IP
+func DeriveFamily(ip net.IP) Family {
+	if ip.To4() != nil {
+		return IPv4
+	}
+	return IPv6
+}
+
+// Configuration is the configuration passed into NewIPAM()
+type Configuration interface {
+	IPv4Enabled() bool
+	IPv6Enabled() bool
+}
+
+// PoolSelector is implemented by Configuration to route an allocation to a
+// named pool based on its metadata, e.g. mapping a Kubernetes namespace to a
+// dedicated CIDR. Returning "" selects defaultPoolName.
+type PoolSelector interface {
+	SelectPool(metadata types.Metadata) string
+}
+
+// AllocationResult is the result of an allocation
+type AllocationResult struct {
+	// IP is the allocated IP
+	IP net.IP
+
+	// IPPoolName is the IPAM pool from which the above IP was allocated from
+	IPPoolName string
+
+	// ExpirationUUID is the UUID of the expiration timer, if set
+	ExpirationUUID string
+}
+
+// Allocator is the interface for an IP allocator implementation
+type Allocator interface {
+	// Allocate allocates a specific IP or fails
+	Allocate(ip net.IP, metadata types.Metadata) (*AllocationResult, error)
+
+	// AllocateWithoutSyncUpstream allocates a specific IP without syncing
+	// upstream
+	AllocateWithoutSyncUpstream(ip net.IP, metadata types.Metadata) (*AllocationResult, error)
+
+	// AllocateNext allocates the next available IP out of the pool
+	AllocateNext(metadata types.Metadata) (*AllocationResult, error)
+
+	// AllocateNextWithoutSyncUpstream allocates the next available IP out
+	// of the pool without syncing upstream
+	AllocateNextWithoutSyncUpstream(metadata types.Metadata) (*AllocationResult, error)
+
+	// Release releases a previously allocated IP
+	Release(ip net.IP) error
+
+	// Dump returns a map of all allocated IPs and a textual description
+	// of the allocator state
+	Dump() (map[string]string, string)
+}
+
+// PoolSizer is an optional extension of Allocator that reports the total
+// number of IPs available for allocation. QuotaPolicy consults it to
+// determine fair-share utilization; an Allocator that does not implement it
+// is treated as unbounded, i.e. fair-share preference always allows.
+type PoolSizer interface {
+	PoolSize() int
+}
+
+// CIDRProvider is an optional extension of Allocator that reports the CIDRs
+// it serves. ContainsIP consults it to validate a user-supplied static IP;
+// an Allocator that does not implement it is simply skipped by ContainsIP.
+type CIDRProvider interface {
+	CIDRs() []*net.IPNet
+}
+
+// ipBlacklist tracks IPs that are blacklisted from allocation
+type ipBlacklist struct {
+	ips map[string]struct{}
+}
+
+// Contains returns true if the IP is blacklisted
+func (b ipBlacklist) Contains(ip net.IP) bool {
+	if b.ips == nil {
+		return false
+	}
+	_, ok := b.ips[ip.String()]
+	return ok
+}
+
+// defaultPoolName identifies the pool used when the Configuration does not
+// select a named pool for an allocation, and is the pool NewIPAM's
+// ipv4Allocator/ipv6Allocator arguments are registered under.
+const defaultPoolName = "default"
+
+// IPAM is the top-level structure coordinating IP allocation out of a set of
+// configured allocators. All exported allocation and release functions are
+// safe to call concurrently.
+type IPAM struct {
+	Configuration Configuration
+
+	owner            map[string]string
+	expirationTimers map[string]string
+
+	// ipv6Pools and ipv4Pools hold the allocators backing each named
+	// pool, keyed by pool name. A pool need not exist for both families.
+	ipv6Pools map[string]Allocator
+	ipv4Pools map[string]Allocator
+
+	// poolOfIP is a reverse index from an allocated IP to the name of
+	// the pool it was allocated from, so that ReleaseIP does not require
+	// the caller to remember which pool an IP came from.
+	poolOfIP map[string]string
+
+	allocatorMutex lock.RWMutex
+	blacklist      ipBlacklist
+
+	// expirationStore persists expiration timers so that they survive a
+	// cilium-agent restart. It may be nil, in which case expiration
+	// timers are kept in memory only, as before.
+	expirationStore ExpirationStore
+
+	// quotaPolicy caps how many IPs a single owner may hold concurrently.
+	// It is nil unless the Configuration implements
+	// OwnerQuotaConfiguration.
+	quotaPolicy *QuotaPolicy
+
+	// events fans out the allocation lifecycle to Subscribe() callers
+	events *eventBroadcaster
+}
+
+// NewIPAM creates a new IPAM instance with the provided per-family
+// allocators. The returned IPAM has no allocations or expiration timers
+// registered yet.
+func NewIPAM(ipv4Allocator, ipv6Allocator Allocator, c Configuration) *IPAM {
+	ipam := &IPAM{
+		Configuration:    c,
+		owner:            map[string]string{},
+		expirationTimers: map[string]string{},
+		ipv4Pools:        map[string]Allocator{},
+		ipv6Pools:        map[string]Allocator{},
+		poolOfIP:         map[string]string{},
+		events:           newEventBroadcaster(),
+	}
+
+	if ipv4Allocator != nil {
+		ipam.ipv4Pools[defaultPoolName] = ipv4Allocator
+	}
+	if ipv6Allocator != nil {
+		ipam.ipv6Pools[defaultPoolName] = ipv6Allocator
+	}
+
+	if quotaConfig, ok := c.(OwnerQuotaConfiguration); ok {
+		ipam.quotaPolicy = NewQuotaPolicy(quotaConfig)
+	}
+
+	return ipam
+}
+
+// RegisterPool adds allocator as a named pool for family. It returns an
+// error if a pool of that name is already registered for family. Pools
+// registered this way become eligible targets for AllocateFromPool and for
+// Configuration's PoolSelector.
+func (ipam *IPAM) RegisterPool(family Family, name string, allocator Allocator) error {
+	ipam.allocatorMutex.Lock()
+	defer ipam.allocatorMutex.Unlock()
+
+	pools := ipam.poolsForFamily(family)
+	if pools == nil {
+		return fmt.Errorf("unknown address family %q", family)
+	}
+
+	if _, ok := pools[name]; ok {
+		return fmt.Errorf("pool %q is already registered for family %s", name, family)
+	}
+
+	pools[name] = allocator
+	return nil
+}
+
+// NewIPAMWithExpirationStore is identical to NewIPAM but additionally wires
+// up store as the backing ExpirationStore and replays any expiration
+// timers persisted by a previous cilium-agent instance: entries whose
+// deadline has already passed are released immediately, remaining entries
+// have their goroutines re-armed with the residual timeout.
+func NewIPAMWithExpirationStore(ipv4Allocator, ipv6Allocator Allocator, c Configuration, store ExpirationStore) (*IPAM, error) {
+	ipam := NewIPAM(ipv4Allocator, ipv6Allocator, c)
+	ipam.expirationStore = store
+
+	entries, err := store.List()
+	if err != nil {
+		return nil, fmt.Errorf("unable to replay expiration store: %w", err)
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		ip := net.ParseIP(entry.IP)
+		if ip == nil {
+			log.WithField("ip", entry.IP).Warning("Ignoring malformed IP in expiration store")
+			continue
+		}
+
+		pool := entry.Pool
+		if pool == "" {
+			// Entries persisted before named pools existed have no
+			// Pool recorded; they can only have come from the
+			// default pool.
+			pool = defaultPoolName
+		}
+
+		allocator := ipam.allocatorForPool(DeriveFamily(ip), pool)
+		if allocator == nil {
+			log.WithFields(logrus.Fields{"ip": entry.IP, "pool": pool}).
+				Warning("Ignoring IP in expiration store: no allocator for its pool/address family")
+			continue
+		}
+
+		// The real allocator has no idea this IP was ever handed out; it
+		// was constructed fresh for this agent run. Mark it allocated
+		// there before touching any IPAM bookkeeping, otherwise a
+		// concurrent AllocateNext could hand the same IP to a second
+		// owner.
+		if _, err := allocator.AllocateWithoutSyncUpstream(ip, types.Metadata{Owner: entry.Owner}); err != nil {
+			log.WithError(err).WithField("ip", entry.IP).
+				Warning("Unable to mark IP from expiration store as allocated; skipping replay")
+			continue
+		}
+
+		residual := entry.Deadline.Sub(now)
+		if residual <= 0 {
+			ipam.allocatorMutex.Lock()
+			ipam.owner[entry.IP] = entry.Owner
+			ipam.poolOfIP[entry.IP] = pool
+			ipam.quotaPolicy.Account(entry.Owner, 1)
+			if err := ipam.releaseIPLocked(ip); err != nil {
+				log.WithError(err).WithField("ip", entry.IP).
+					Warning("Unable to release expired IP replayed from expiration store")
+			}
+			ipam.allocatorMutex.Unlock()
+			continue
+		}
+
+		ipam.allocatorMutex.Lock()
+		ipam.owner[entry.IP] = entry.Owner
+		ipam.poolOfIP[entry.IP] = pool
+		ipam.expirationTimers[entry.IP] = entry.UUID
+		ipam.quotaPolicy.Account(entry.Owner, 1)
+		ipam.allocatorMutex.Unlock()
+
+		ipam.armExpirationTimer(ip, entry.UUID, residual)
+	}
+
+	return ipam, nil
+}
+
+func (ipam *IPAM) poolsForFamily(family Family) map[string]Allocator {
+	switch family {
+	case IPv6:
+		return ipam.ipv6Pools
+	case IPv4:
+		return ipam.ipv4Pools
+	default:
+		return nil
+	}
+}
+
+// allocatorByFamily returns the default pool's allocator for family, or nil
+// if family is unknown or has no default pool configured.
+func (ipam *IPAM) allocatorByFamily(family Family) Allocator {
+	return ipam.poolsForFamily(family)[defaultPoolName]
+}
+
+// IPv4Allocator returns the Allocator backing the default IPv4 pool, or nil
+// if IPv4 is not enabled. This replaces the exported IPv4Allocator field
+// that existed before named pools were introduced; update call sites from
+// ipam.IPv4Allocator to ipam.IPv4Allocator().
+func (ipam *IPAM) IPv4Allocator() Allocator {
+	ipam.allocatorMutex.RLock()
+	defer ipam.allocatorMutex.RUnlock()
+	return ipam.allocatorByFamily(IPv4)
+}
+
+// IPv6Allocator returns the Allocator backing the default IPv6 pool, or nil
+// if IPv6 is not enabled. This replaces the exported IPv6Allocator field
+// that existed before named pools were introduced; update call sites from
+// ipam.IPv6Allocator to ipam.IPv6Allocator().
+func (ipam *IPAM) IPv6Allocator() Allocator {
+	ipam.allocatorMutex.RLock()
+	defer ipam.allocatorMutex.RUnlock()
+	return ipam.allocatorByFamily(IPv6)
+}
+
+// allocatorForPool returns the allocator backing the named pool for family.
+// An empty pool name resolves to defaultPoolName.
+func (ipam *IPAM) allocatorForPool(family Family, pool string) Allocator {
+	if pool == "" {
+		pool = defaultPoolName
+	}
+	return ipam.poolsForFamily(family)[pool]
+}
+
+// ContainsIP reports whether ip falls within any CIDR backing a configured
+// pool of the matching address family, returning the name of a matching
+// pool; if several pools match, which of them is returned is not defined.
+// This lets callers such as the CNI daemon validate a
+// user-supplied static IP up-front, before calling AllocateIP, and
+// distinguish "bad input" from "pool exhausted".
+//
+// If no pool of the matching family implements CIDRProvider, there is
+// nothing to validate ip against, so it is treated as contained (ok is true,
+// pool is "") rather than rejected, mirroring how PoolSizer treats an
+// allocator that doesn't implement it as unbounded.
+func (ipam *IPAM) ContainsIP(ip net.IP) (pool string, ok bool) {
+	ipam.allocatorMutex.RLock()
+	defer ipam.allocatorMutex.RUnlock()
+
+	return ipam.containsIPLocked(ip)
+}
+
+func (ipam *IPAM) containsIPLocked(ip net.IP) (pool string, ok bool) {
+	anyCIDRProvider := false
+
+	for name, allocator := range ipam.poolsForFamily(DeriveFamily(ip)) {
+		provider, isProvider := allocator.(CIDRProvider)
+		if !isProvider {
+			continue
+		}
+		anyCIDRProvider = true
+
+		for _, cidr := range provider.CIDRs() {
+			if cidr.Contains(ip) {
+				return name, true
+			}
+		}
+	}
+
+	return "", !anyCIDRProvider
+}
+
+// selectPool determines which pool an allocation for metadata should use,
+// consulting Configuration's PoolSelector if implemented and falling back
+// to defaultPoolName otherwise.
+func (ipam *IPAM) selectPool(metadata types.Metadata) string {
+	if selector, ok := ipam.Configuration.(PoolSelector); ok {
+		if pool := selector.SelectPool(metadata); pool != "" {
+			return pool
+		}
+	}
+	return defaultPoolName
+}
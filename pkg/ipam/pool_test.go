@@ -0,0 +1,132 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cilium/cilium/pkg/ipam/types"
+)
+
+// poolSelectorTestConfig routes any owner with the "dedicated/" prefix into
+// the "dedicated" pool, leaving everyone else on the default pool.
+type poolSelectorTestConfig struct{}
+
+func (poolSelectorTestConfig) IPv4Enabled() bool { return true }
+func (poolSelectorTestConfig) IPv6Enabled() bool { return true }
+
+func (poolSelectorTestConfig) SelectPool(metadata types.Metadata) string {
+	if strings.HasPrefix(metadata.Owner, "dedicated/") {
+		return "dedicated"
+	}
+	return ""
+}
+
+func TestRegisterPoolRejectsDuplicateName(t *testing.T) {
+	ipam := NewIPAM(newFakeRangeAllocator(0), nil, fakeTestConfig{})
+
+	if err := ipam.RegisterPool(IPv4, "extra", newFakeRangeAllocator(0)); err != nil {
+		t.Fatalf("unexpected error registering pool: %v", err)
+	}
+	if err := ipam.RegisterPool(IPv4, "extra", newFakeRangeAllocator(0)); err == nil {
+		t.Fatal("expected registering a pool name twice to fail")
+	}
+}
+
+func TestAllocateFromPoolTargetsNamedPool(t *testing.T) {
+	ipam := NewIPAM(newFakeRangeAllocator(0), nil, fakeTestConfig{})
+	extra := newFakeRangeAllocator(0)
+	if err := ipam.RegisterPool(IPv4, "extra", extra); err != nil {
+		t.Fatalf("unexpected error registering pool: %v", err)
+	}
+
+	result, err := ipam.AllocateFromPool("extra", IPv4, types.Metadata{Owner: "ns/pod-a"})
+	if err != nil {
+		t.Fatalf("unexpected error from AllocateFromPool: %v", err)
+	}
+
+	if result.IPPoolName != "extra" {
+		t.Fatalf("expected allocation to report pool %q, got %q", "extra", result.IPPoolName)
+	}
+	if _, ok := extra.allocated[result.IP.String()]; !ok {
+		t.Fatal("expected the IP to be allocated against the named pool's allocator, not the default pool")
+	}
+	if pool := ipam.poolOfIP[result.IP.String()]; pool != "extra" {
+		t.Fatalf("expected poolOfIP to record %q, got %q", "extra", pool)
+	}
+}
+
+func TestAllocateNextFamilyUsesPoolSelector(t *testing.T) {
+	ipam := NewIPAM(newFakeRangeAllocator(0), nil, poolSelectorTestConfig{})
+	dedicated := newFakeRangeAllocator(0)
+	if err := ipam.RegisterPool(IPv4, "dedicated", dedicated); err != nil {
+		t.Fatalf("unexpected error registering pool: %v", err)
+	}
+
+	result, err := ipam.AllocateNextFamily(IPv4, types.Metadata{Owner: "dedicated/pod-a"})
+	if err != nil {
+		t.Fatalf("unexpected error from AllocateNextFamily: %v", err)
+	}
+
+	if result.IPPoolName != "dedicated" {
+		t.Fatalf("expected PoolSelector to route the allocation to %q, got %q", "dedicated", result.IPPoolName)
+	}
+	if _, ok := dedicated.allocated[result.IP.String()]; !ok {
+		t.Fatal("expected the IP to be allocated against the dedicated pool's allocator")
+	}
+}
+
+func TestReleaseIPUsesRecordedPool(t *testing.T) {
+	ipam := NewIPAM(newFakeRangeAllocator(0), nil, fakeTestConfig{})
+	extra := newFakeRangeAllocator(0)
+	if err := ipam.RegisterPool(IPv4, "extra", extra); err != nil {
+		t.Fatalf("unexpected error registering pool: %v", err)
+	}
+
+	result, err := ipam.AllocateFromPool("extra", IPv4, types.Metadata{Owner: "ns/pod-a"})
+	if err != nil {
+		t.Fatalf("unexpected error from AllocateFromPool: %v", err)
+	}
+
+	if err := ipam.ReleaseIP(result.IP); err != nil {
+		t.Fatalf("unexpected error releasing IP: %v", err)
+	}
+
+	if _, ok := extra.allocated[result.IP.String()]; ok {
+		t.Fatal("expected ReleaseIP to release the IP from the pool it was actually allocated from")
+	}
+	if _, ok := ipam.poolOfIP[result.IP.String()]; ok {
+		t.Fatal("expected poolOfIP bookkeeping to be cleared after release")
+	}
+}
+
+func TestDumpCoversNonDefaultPools(t *testing.T) {
+	ipam := NewIPAM(newFakeRangeAllocator(0), nil, fakeTestConfig{})
+	extra := newFakeRangeAllocator(0)
+	if err := ipam.RegisterPool(IPv4, "extra", extra); err != nil {
+		t.Fatalf("unexpected error registering pool: %v", err)
+	}
+
+	result, err := ipam.AllocateFromPool("extra", IPv4, types.Metadata{Owner: "ns/pod-a"})
+	if err != nil {
+		t.Fatalf("unexpected error from AllocateFromPool: %v", err)
+	}
+
+	allocv4, _, _ := ipam.Dump()
+	if _, ok := allocv4[result.IP.String()]; !ok {
+		t.Fatalf("expected Dump to include IPs allocated from non-default pools, got %v", allocv4)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/cilium/cilium/pkg/metrics"
+)
+
+// ErrOwnerQuotaExceeded is returned when an owner has reached its configured
+// IP quota and AllocateNext prefers other, below-fair-share owners instead.
+var ErrOwnerQuotaExceeded = errors.New("owner IP quota exceeded")
+
+// fairShareThreshold is the pool utilization (0-1) at or above which AllocateNext
+// starts preferring owners that are below their fair share over owners that
+// have already exceeded it, even if neither has hit a hard quota.
+const fairShareThreshold = 0.9
+
+// OwnerQuotaConfiguration is implemented by Configuration to surface
+// per-owner (or owner-prefix) quotas to the QuotaPolicy.
+type OwnerQuotaConfiguration interface {
+	// OwnerQuota returns the maximum number of concurrently held IPs for
+	// owner, or 0 if owner is unbounded. Implementations may match owner
+	// by prefix, e.g. a Kubernetes namespace.
+	OwnerQuota(owner string) int
+}
+
+// QuotaPolicy caps how many IPs a single owner (or owner-prefix) may hold
+// concurrently and implements a weighted fair-share mode used once the pool
+// is nearly exhausted, so that one noisy owner cannot starve the rest.
+//
+// counts is keyed by ownerPrefix(owner) rather than the raw owner string, so
+// that e.g. every pod in the same namespace shares one counter and a
+// namespace-wide quota actually caps the namespace instead of each pod
+// individually.
+type QuotaPolicy struct {
+	config OwnerQuotaConfiguration
+	counts map[string]int
+}
+
+// NewQuotaPolicy creates a QuotaPolicy backed by config. config may be nil,
+// in which case no owner is ever considered over quota.
+func NewQuotaPolicy(config OwnerQuotaConfiguration) *QuotaPolicy {
+	return &QuotaPolicy{
+		config: config,
+		counts: map[string]int{},
+	}
+}
+
+func (q *QuotaPolicy) quotaFor(owner string) int {
+	if q == nil || q.config == nil {
+		return 0
+	}
+	return q.config.OwnerQuota(owner)
+}
+
+// Allow reports whether owner may be granted one more IP. It must be called
+// with the IPAM allocatorMutex held, mirroring how the owner bookkeeping in
+// allocator.go is protected.
+func (q *QuotaPolicy) Allow(owner string) error {
+	if q == nil {
+		return nil
+	}
+
+	quota := q.quotaFor(owner)
+	if quota <= 0 {
+		return nil
+	}
+
+	if q.counts[ownerPrefix(owner)] >= quota {
+		return ErrOwnerQuotaExceeded
+	}
+
+	return nil
+}
+
+// Account records that delta IPs were allocated to (delta > 0) or released
+// from (delta < 0) owner.
+func (q *QuotaPolicy) Account(owner string, delta int) {
+	if q == nil {
+		return
+	}
+
+	prefix := ownerPrefix(owner)
+	q.counts[prefix] += delta
+	if q.counts[prefix] <= 0 {
+		delete(q.counts, prefix)
+	}
+
+	if q.quotaFor(owner) > 0 {
+		metrics.IpamOwnerQuotaUsage.WithLabelValues(prefix).Set(float64(q.counts[prefix]))
+	}
+}
+
+// PreferOwner reports whether owner should be preferred for the next
+// allocation once the pool has crossed fairShareThreshold utilization:
+// owners currently below their fair share of poolSize are preferred over
+// owners that are already at or above it.
+func (q *QuotaPolicy) PreferOwner(owner string, poolSize, allocated int) bool {
+	if q == nil || poolSize <= 0 {
+		return true
+	}
+
+	if float64(allocated)/float64(poolSize) < fairShareThreshold {
+		return true
+	}
+
+	activeOwners := len(q.counts)
+	if activeOwners == 0 {
+		return true
+	}
+
+	fairShare := poolSize / activeOwners
+	if fairShare <= 0 {
+		fairShare = 1
+	}
+
+	return q.counts[ownerPrefix(owner)] < fairShare
+}
+
+// ownerPrefix returns the namespace-like prefix of owner, e.g. the
+// "namespace" part of a "namespace/pod" owner string used throughout
+// cilium's Kubernetes integration.
+func ownerPrefix(owner string) string {
+	if idx := strings.IndexByte(owner, '/'); idx >= 0 {
+		return owner[:idx]
+	}
+	return owner
+}
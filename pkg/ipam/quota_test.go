@@ -0,0 +1,70 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import "testing"
+
+func TestQuotaPolicyPreferOwnerBelowThreshold(t *testing.T) {
+	q := NewQuotaPolicy(nil)
+	q.Account("ns/pod-a", 89)
+
+	// 89/100 utilization is below fairShareThreshold, so fair-share mode
+	// has not kicked in yet and every owner is preferred.
+	if !q.PreferOwner("ns/pod-a", 100, 89) {
+		t.Fatal("expected owner to be preferred below the fair-share threshold")
+	}
+}
+
+func TestQuotaPolicyPreferOwnerFairShare(t *testing.T) {
+	q := NewQuotaPolicy(nil)
+	q.Account("ns-a/pod-1", 80)
+	q.Account("ns-b/pod-1", 10)
+
+	// 90/100 crosses fairShareThreshold. fairShare is 100/2 = 50. ns-b is
+	// well below its fair share and should be preferred over ns-a, which
+	// has already blown past it.
+	if q.PreferOwner("ns-a/pod-1", 100, 90) {
+		t.Fatal("expected owner above fair share not to be preferred once the pool is nearly full")
+	}
+	if !q.PreferOwner("ns-b/pod-1", 100, 90) {
+		t.Fatal("expected owner below fair share to be preferred once the pool is nearly full")
+	}
+}
+
+func TestQuotaPolicyAggregatesByOwnerPrefix(t *testing.T) {
+	q := NewQuotaPolicy(nil)
+	q.Account("ns-a/pod-1", 45)
+	q.Account("ns-a/pod-2", 45)
+	q.Account("ns-b/pod-1", 5)
+
+	// 95/100 crosses fairShareThreshold with 2 active prefixes, so
+	// fairShare is 50. ns-a/pod-1 only allocated 45 IPs itself, below 50,
+	// but its namespace ("ns-a") has allocated 90 across both pods. If
+	// counts were keyed by the raw owner string instead of the prefix,
+	// pod-1 would be wrongly preferred; keyed by prefix it must not be.
+	if q.PreferOwner("ns-a/pod-1", 100, 95) {
+		t.Fatal("expected the namespace-aggregated count, not the individual pod's count, to gate fair share")
+	}
+}
+
+func TestQuotaPolicyAccountRemovesZeroedCounts(t *testing.T) {
+	q := NewQuotaPolicy(nil)
+	q.Account("ns/pod-1", 1)
+	q.Account("ns/pod-1", -1)
+
+	if _, ok := q.counts["ns"]; ok {
+		t.Fatal("expected a zeroed owner-prefix count to be removed from the map")
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cilium/cilium/pkg/ipam/types"
+	"github.com/cilium/cilium/pkg/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AllocateRange is identical to AllocateRangeFromPool but targets the pool
+// selected by Configuration for metadata.
+func (ipam *IPAM) AllocateRange(family Family, count int, metadata types.Metadata) ([]*AllocationResult, error) {
+	return ipam.AllocateRangeFromPool(ipam.selectPool(metadata), family, count, metadata)
+}
+
+// AllocateRangeFromPool allocates count IPs of the requested family out of
+// the named pool in a single critical section, bypassing Configuration's
+// pool selector -- the bulk equivalent of AllocateFromPool. This is
+// considerably cheaper than calling AllocateNextFamily count times, as the
+// allocator mutex is only acquired once.
+//
+// If the pool is drained before count IPs could be allocated, all IPs
+// allocated as part of this call are released again and an error is
+// returned.
+func (ipam *IPAM) AllocateRangeFromPool(pool string, family Family, count int, metadata types.Metadata) ([]*AllocationResult, error) {
+	if count <= 0 {
+		return nil, fmt.Errorf("count must be positive, got %d", count)
+	}
+
+	if pool == "" {
+		pool = defaultPoolName
+	}
+
+	ipam.allocatorMutex.Lock()
+	defer ipam.allocatorMutex.Unlock()
+
+	allocator := ipam.allocatorForPool(family, pool)
+	if allocator == nil {
+		return nil, fmt.Errorf("%s allocator not available for pool %q", family, pool)
+	}
+
+	results := make([]*AllocationResult, 0, count)
+
+	rollback := func() {
+		for _, result := range results {
+			if err := ipam.releaseIPLocked(result.IP); err != nil {
+				log.WithError(err).WithField("ip", result.IP.String()).
+					Warning("Unable to roll back partial bulk allocation")
+			}
+		}
+	}
+
+	for len(results) < count {
+		if err := ipam.quotaPolicy.Allow(metadata.Owner); err != nil {
+			rollback()
+			return nil, err
+		}
+
+		result, err := allocator.AllocateNextWithoutSyncUpstream(metadata)
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("unable to allocate IP %d/%d: %w", len(results)+1, count, err)
+		}
+
+		if ipam.blacklist.Contains(result.IP) {
+			ipam.owner[result.IP.String()] = fmt.Sprintf("%s (blacklisted)", metadata.Owner)
+			ipam.poolOfIP[result.IP.String()] = pool
+			ipam.events.publish(IPAMEvent{
+				Op:        Blacklist,
+				IP:        result.IP,
+				Family:    family,
+				Owner:     metadata.Owner,
+				Timestamp: time.Now(),
+			})
+			continue
+		}
+
+		ipam.owner[result.IP.String()] = metadata.Owner
+		ipam.poolOfIP[result.IP.String()] = pool
+		ipam.quotaPolicy.Account(metadata.Owner, 1)
+		result.IPPoolName = pool
+		results = append(results, result)
+
+		metrics.IpamEvent.WithLabelValues(metricAllocate, string(family), pool).Inc()
+		ipam.events.publish(IPAMEvent{
+			Op:        Allocate,
+			IP:        result.IP,
+			Family:    family,
+			Owner:     metadata.Owner,
+			Timestamp: time.Now(),
+		})
+	}
+
+	log.WithFields(logrus.Fields{
+		"family": family,
+		"pool":   pool,
+		"owner":  metadata.Owner,
+		"count":  count,
+	}).Debug("Bulk allocated IP range")
+
+	return results, nil
+}
+
+// maxReserveCIDRSize is the largest number of addresses ReserveCIDR will
+// iterate over. It holds the allocator mutex for the duration of the call,
+// so a caller-controlled CIDR must be bounded; a full IPv4 /0 or /8 would
+// otherwise hold the lock for millions of Allocate calls, and a full /0
+// would never terminate at all, since nextIP wraps back to the network
+// address.
+const maxReserveCIDRSize = 1 << 16
+
+// ReserveCIDR is identical to ReserveCIDRInPool but targets defaultPoolName.
+func (ipam *IPAM) ReserveCIDR(cidr *net.IPNet, owner string) error {
+	return ipam.ReserveCIDRInPool(defaultPoolName, cidr, owner)
+}
+
+// ReserveCIDRInPool marks every IP of the given CIDR as allocated to owner
+// out of the named pool in a single critical section -- the bulk equivalent
+// of AllocateFromPool. If any IP within the CIDR is already allocated or
+// blacklisted, the reservation is aborted, any IPs reserved so far as part
+// of this call are released again, and an error is returned.
+func (ipam *IPAM) ReserveCIDRInPool(pool string, cidr *net.IPNet, owner string) error {
+	family := DeriveFamily(cidr.IP)
+
+	if pool == "" {
+		pool = defaultPoolName
+	}
+
+	ones, bits := cidr.Mask.Size()
+	if bits-ones > 16 {
+		return fmt.Errorf("unable to reserve %s: CIDR is too large, maximum %d addresses", cidr.String(), maxReserveCIDRSize)
+	}
+
+	ipam.allocatorMutex.Lock()
+	defer ipam.allocatorMutex.Unlock()
+
+	allocator := ipam.allocatorForPool(family, pool)
+	if allocator == nil {
+		return fmt.Errorf("%s allocator not available for pool %q", family, pool)
+	}
+
+	reserved := make([]net.IP, 0)
+
+	rollback := func() {
+		for _, ip := range reserved {
+			if err := ipam.releaseIPLocked(ip); err != nil {
+				log.WithError(err).WithField("ip", ip.String()).
+					Warning("Unable to roll back partial CIDR reservation")
+			}
+		}
+	}
+
+	for ip := cidr.IP.Mask(cidr.Mask); cidr.Contains(ip); ip = nextIP(ip) {
+		reservedIP := copyIP(ip)
+
+		if ipam.blacklist.Contains(reservedIP) {
+			rollback()
+			return fmt.Errorf("unable to reserve %s: IP %s is blacklisted", cidr.String(), reservedIP.String())
+		}
+
+		if err := ipam.quotaPolicy.Allow(owner); err != nil {
+			rollback()
+			return fmt.Errorf("unable to reserve %s: %w", cidr.String(), err)
+		}
+
+		if _, err := allocator.Allocate(reservedIP, types.Metadata{Owner: owner}); err != nil {
+			rollback()
+			return fmt.Errorf("unable to reserve %s: IP %s is already allocated: %w", cidr.String(), reservedIP.String(), err)
+		}
+
+		ipam.owner[reservedIP.String()] = owner
+		ipam.poolOfIP[reservedIP.String()] = pool
+		ipam.quotaPolicy.Account(owner, 1)
+		reserved = append(reserved, reservedIP)
+
+		metrics.IpamEvent.WithLabelValues(metricAllocate, string(family), pool).Inc()
+		ipam.events.publish(IPAMEvent{
+			Op:        Allocate,
+			IP:        reservedIP,
+			Family:    family,
+			Owner:     owner,
+			Timestamp: time.Now(),
+		})
+	}
+
+	log.WithFields(logrus.Fields{
+		"cidr":  cidr.String(),
+		"pool":  pool,
+		"owner": owner,
+		"count": len(reserved),
+	}).Info("Reserved CIDR for owner")
+
+	return nil
+}
+
+// copyIP returns a defensive copy of ip
+func copyIP(ip net.IP) net.IP {
+	dup := make(net.IP, len(ip))
+	copy(dup, ip)
+	return dup
+}
+
+// nextIP returns the IP address following ip
+func nextIP(ip net.IP) net.IP {
+	next := copyIP(ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
@@ -0,0 +1,210 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/cilium/cilium/pkg/ipam/types"
+)
+
+// fakeTestConfig is the minimal Configuration used by the tests in this
+// file; neither family is gated off and no pool selector or quota is
+// configured unless a test opts in.
+type fakeTestConfig struct{}
+
+func (fakeTestConfig) IPv4Enabled() bool { return true }
+func (fakeTestConfig) IPv6Enabled() bool { return true }
+
+// fakeRangeAllocator is a minimal in-memory Allocator used to exercise
+// AllocateRange/ReserveCIDR without a real host-scope or CRD allocator.
+// AllocateNext hands out sequential IPs 10.0.0.1, 10.0.0.2, ... and fails once
+// failAfter successful allocations have been handed out, to exercise the
+// rollback path.
+type fakeRangeAllocator struct {
+	allocated map[string]string
+	next      byte
+	failAfter int
+}
+
+func newFakeRangeAllocator(failAfter int) *fakeRangeAllocator {
+	return &fakeRangeAllocator{
+		allocated: map[string]string{},
+		failAfter: failAfter,
+	}
+}
+
+func (a *fakeRangeAllocator) Allocate(ip net.IP, metadata types.Metadata) (*AllocationResult, error) {
+	key := ip.String()
+	if _, ok := a.allocated[key]; ok {
+		return nil, fmt.Errorf("IP %s already allocated", key)
+	}
+	a.allocated[key] = metadata.Owner
+	return &AllocationResult{IP: ip}, nil
+}
+
+func (a *fakeRangeAllocator) AllocateWithoutSyncUpstream(ip net.IP, metadata types.Metadata) (*AllocationResult, error) {
+	return a.Allocate(ip, metadata)
+}
+
+func (a *fakeRangeAllocator) AllocateNext(metadata types.Metadata) (*AllocationResult, error) {
+	return a.AllocateNextWithoutSyncUpstream(metadata)
+}
+
+func (a *fakeRangeAllocator) AllocateNextWithoutSyncUpstream(metadata types.Metadata) (*AllocationResult, error) {
+	if a.failAfter > 0 && len(a.allocated) >= a.failAfter {
+		return nil, errors.New("fake allocator exhausted")
+	}
+	a.next++
+	ip := net.IPv4(10, 0, 0, a.next)
+	a.allocated[ip.String()] = metadata.Owner
+	return &AllocationResult{IP: ip}, nil
+}
+
+func (a *fakeRangeAllocator) Release(ip net.IP) error {
+	key := ip.String()
+	if _, ok := a.allocated[key]; !ok {
+		return fmt.Errorf("IP %s is not allocated", key)
+	}
+	delete(a.allocated, key)
+	return nil
+}
+
+func (a *fakeRangeAllocator) Dump() (map[string]string, string) {
+	dump := make(map[string]string, len(a.allocated))
+	for ip, owner := range a.allocated {
+		dump[ip] = owner
+	}
+	return dump, ""
+}
+
+func TestAllocateRangeRollsBackOnFailure(t *testing.T) {
+	allocator := newFakeRangeAllocator(3)
+	ipam := NewIPAM(allocator, nil, fakeTestConfig{})
+
+	_, err := ipam.AllocateRange(IPv4, 5, types.Metadata{Owner: "ns/pod-a"})
+	if err == nil {
+		t.Fatal("expected AllocateRange to fail once the fake allocator is exhausted")
+	}
+
+	if len(allocator.allocated) != 0 {
+		t.Fatalf("expected all partially allocated IPs to be rolled back in the allocator, got %d left", len(allocator.allocated))
+	}
+	if len(ipam.owner) != 0 {
+		t.Fatalf("expected IPAM owner bookkeeping to be rolled back, got %d entries left", len(ipam.owner))
+	}
+	if len(ipam.poolOfIP) != 0 {
+		t.Fatalf("expected IPAM poolOfIP bookkeeping to be rolled back, got %d entries left", len(ipam.poolOfIP))
+	}
+}
+
+func TestReserveCIDRRollsBackOnConflict(t *testing.T) {
+	allocator := newFakeRangeAllocator(0)
+	ipam := NewIPAM(allocator, nil, fakeTestConfig{})
+
+	// Pre-allocate one IP inside the CIDR directly against the fake
+	// allocator, simulating an IP that was already reserved by someone
+	// else, so ReserveCIDR fails partway through and must roll back.
+	conflict := net.IPv4(10, 0, 0, 2)
+	if _, err := allocator.Allocate(conflict, types.Metadata{Owner: "someone-else"}); err != nil {
+		t.Fatalf("unexpected error seeding conflicting IP: %v", err)
+	}
+
+	_, cidr, err := net.ParseCIDR("10.0.0.0/30")
+	if err != nil {
+		t.Fatalf("unexpected error parsing test CIDR: %v", err)
+	}
+
+	if err := ipam.ReserveCIDR(cidr, "ns/pod-b"); err == nil {
+		t.Fatal("expected ReserveCIDR to fail on a pre-allocated IP within the CIDR")
+	}
+
+	if len(allocator.allocated) != 1 {
+		t.Fatalf("expected only the pre-seeded conflicting IP to remain allocated, got %d", len(allocator.allocated))
+	}
+	if owner := allocator.allocated[conflict.String()]; owner != "someone-else" {
+		t.Fatalf("expected the pre-seeded IP's owner to be untouched, got %q", owner)
+	}
+	if len(ipam.owner) != 0 {
+		t.Fatalf("expected IPAM owner bookkeeping to be rolled back, got %d entries left", len(ipam.owner))
+	}
+}
+
+// TestAllocateRangeConcurrentWithRegisterPool exercises AllocateRange and
+// ReserveCIDR concurrently with RegisterPool, which mutates the same
+// ipv4Pools/ipv6Pools maps. Run with -race: before the allocator lookup in
+// both functions was moved inside allocatorMutex, this reliably reported a
+// concurrent map read/write.
+func TestAllocateRangeConcurrentWithRegisterPool(t *testing.T) {
+	ipam := NewIPAM(newFakeRangeAllocator(0), nil, fakeTestConfig{})
+
+	_, cidr, err := net.ParseCIDR("10.1.0.0/30")
+	if err != nil {
+		t.Fatalf("unexpected error parsing test CIDR: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// ReserveCIDR has its own allocatorForPool lookup, so it is
+		// exercised here too.
+		_ = ipam.ReserveCIDR(cidr, "ns/pod-reserve")
+		for i := 0; i < 50; i++ {
+			_, _ = ipam.AllocateRange(IPv4, 1, types.Metadata{Owner: fmt.Sprintf("ns/pod-%d", i)})
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		_ = ipam.RegisterPool(IPv4, fmt.Sprintf("extra-%d", i), newFakeRangeAllocator(0))
+	}
+	<-done
+}
+
+func TestAllocateRangeAndReserveCIDRPublishEvents(t *testing.T) {
+	ipam := NewIPAM(newFakeRangeAllocator(0), nil, fakeTestConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := ipam.Subscribe(ctx)
+
+	if _, err := ipam.AllocateRange(IPv4, 2, types.Metadata{Owner: "ns/pod-a"}); err != nil {
+		t.Fatalf("unexpected error from AllocateRange: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if event := <-events; event.Op != Allocate {
+			t.Fatalf("expected AllocateRange to publish an Allocate event, got %q", event.Op)
+		}
+	}
+
+	_, cidr, err := net.ParseCIDR("10.0.1.0/30")
+	if err != nil {
+		t.Fatalf("unexpected error parsing test CIDR: %v", err)
+	}
+
+	if err := ipam.ReserveCIDR(cidr, "ns/pod-b"); err != nil {
+		t.Fatalf("unexpected error from ReserveCIDR: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if event := <-events; event.Op != Allocate {
+			t.Fatalf("expected ReserveCIDR to publish an Allocate event, got %q", event.Op)
+		}
+	}
+}
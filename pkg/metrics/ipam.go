@@ -0,0 +1,55 @@
+// Copyright 2016-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Namespace is the Prometheus namespace shared by all Cilium metrics.
+	Namespace = "cilium"
+
+	// SubsystemIPAM is the subsystem under which pkg/ipam registers its metrics.
+	SubsystemIPAM = "ipam"
+)
+
+var (
+	// IpamEvent is the number of IPAM events received, labelled by the
+	// operation (e.g. "allocate", "release"), the address family it was
+	// performed against, and the pool the IP was allocated from or
+	// released back into.
+	IpamEvent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: SubsystemIPAM,
+		Name:      "events_total",
+		Help:      "Number of IPAM events received",
+	}, []string{"op", "family", "pool"})
+
+	// IpamOwnerQuotaUsage is the number of IPs currently held by an
+	// owner (or owner-prefix, e.g. a Kubernetes namespace) that has a
+	// configured quota.
+	IpamOwnerQuotaUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: SubsystemIPAM,
+		Name:      "owner_quota_usage",
+		Help:      "Number of IPs currently allocated to an owner with a configured quota",
+	}, []string{"owner"})
+)
+
+func init() {
+	prometheus.MustRegister(IpamEvent)
+	prometheus.MustRegister(IpamOwnerQuotaUsage)
+}